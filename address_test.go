@@ -0,0 +1,63 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import "testing"
+
+func TestParseAddressListQuotedComma(t *testing.T) {
+	addrs, err := ParseAddressList(`"Doe, John" <j@x.com>, jane@x.com`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Address{
+		{Name: "Doe, John", Email: "j@x.com"},
+		{Email: "jane@x.com"},
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got %v addresses, want %v: %+v", len(addrs), len(want), addrs)
+	}
+	for i, a := range addrs {
+		if a != want[i] {
+			t.Errorf("addrs[%v] = %+v, want %+v", i, a, want[i])
+		}
+	}
+}
+
+func TestParseAddressListGroup(t *testing.T) {
+	addrs, err := ParseAddressList(`undisclosed-recipients:;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(addrs) != 0 {
+		t.Errorf("got %+v, want no addresses", addrs)
+	}
+
+	addrs, err = ParseAddressList(`Group: a@b.com, "Foo, Bar" <c@d.com>;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Address{
+		{Email: "a@b.com"},
+		{Name: "Foo, Bar", Email: "c@d.com"},
+	}
+	if len(addrs) != len(want) {
+		t.Fatalf("got %v addresses, want %v: %+v", len(addrs), len(want), addrs)
+	}
+	for i, a := range addrs {
+		if a != want[i] {
+			t.Errorf("addrs[%v] = %+v, want %+v", i, a, want[i])
+		}
+	}
+}
+
+func TestParseAddressListEmpty(t *testing.T) {
+	addrs, err := ParseAddressList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addrs != nil {
+		t.Errorf("got %+v, want nil", addrs)
+	}
+}
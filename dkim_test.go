@@ -0,0 +1,89 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"testing"
+)
+
+// testDKIMResolver answers LookupTXT with a single canned DKIM public-key
+// record, as published at selector._domainkey.domain.
+type testDKIMResolver struct {
+	selector, domain, record string
+}
+
+func (r testDKIMResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	if domain != r.selector+"._domainkey."+r.domain {
+		return nil, fmt.Errorf("no such record: %v", domain)
+	}
+	return []string{r.record}, nil
+}
+
+func TestSignVerifyDKIM(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signer := &DKIMSigner{
+		Domain:   "example.com",
+		Selector: "sel",
+		Signer:   key,
+	}
+
+	m := NewMessage("from@example.com", []string{"to@x.com"}, nil, "subject", "hello world", nil)
+	raw, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	signed := new(bytes.Buffer)
+	if err := signer.Sign(signed, raw); err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+
+	got, err := ReadMessage(signed)
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+
+	resolver := testDKIMResolver{
+		selector: "sel",
+		domain:   "example.com",
+		record:   "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub),
+	}
+
+	results, err := got.VerifyDKIM(context.Background(), resolver)
+	if err != nil {
+		t.Fatalf("VerifyDKIM: %v", err)
+	}
+	if len(results) != 1 {
+		t.Fatalf("got %v results, want 1: %+v", len(results), results)
+	}
+	if results[0].Status() != "pass" {
+		t.Errorf("Status() = %q, want %q (err: %v)", results[0].Status(), "pass", results[0].Err)
+	}
+	if results[0].Domain != "example.com" {
+		t.Errorf("Domain = %q, want %q", results[0].Domain, "example.com")
+	}
+}
+
+func TestVerifyDKIMWithoutRaw(t *testing.T) {
+	m := NewMessage("from@example.com", []string{"to@x.com"}, nil, "subject", "hello world", nil)
+	if _, err := m.VerifyDKIM(context.Background(), nil); err == nil {
+		t.Error("expected an error verifying a message not produced by ReadMessage")
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/jaytaylor/html2text"
+)
+
+// HTMLConverter derives a plain-text Body from a message's HTML part.
+// ReadMessageOptions.HTMLConverter controls which one ReadMessageWithOptions
+// uses; HTML2Text is the default, matching ReadMessage's long-standing
+// behavior.
+type HTMLConverter interface {
+	Convert(htm string) (string, error)
+}
+
+// htmlConverterFunc adapts a function to an HTMLConverter.
+type htmlConverterFunc func(htm string) (string, error)
+
+func (f htmlConverterFunc) Convert(htm string) (string, error) { return f(htm) }
+
+var (
+	// HTML2Text renders HTML into readable plain text (links, lists, tables
+	// and the like) via jaytaylor/html2text.
+	HTML2Text HTMLConverter = htmlConverterFunc(func(htm string) (string, error) {
+		return html2text.FromString(htm)
+	})
+
+	// StripHTMLTags produces plain text by discarding tags and keeping only
+	// their text content, with none of HTML2Text's formatting. Good enough
+	// for previews, and much cheaper.
+	StripHTMLTags HTMLConverter = htmlConverterFunc(stripTags)
+
+	// KeepHTML leaves Body empty instead of deriving it; only m.HTML is
+	// populated. Use this when a caller renders HTML directly and has no
+	// use for a text body.
+	KeepHTML HTMLConverter = htmlConverterFunc(func(htm string) (string, error) {
+		return "", nil
+	})
+)
+
+// stripTags walks htm's tokens and concatenates its text nodes.
+func stripTags(htm string) (string, error) {
+	z := html.NewTokenizer(strings.NewReader(htm))
+	buf := new(bytes.Buffer)
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			if err := z.Err(); err != io.EOF {
+				return "", err
+			}
+			return buf.String(), nil
+		case html.TextToken:
+			buf.Write(z.Text())
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package imapfetch connects to an IMAP server, searches a mailbox and
+// yields the matching messages as *mail.Message, symmetric to the outbound
+// path in mail.Message.SendVia. It also knows how to save Parts of fetched
+// messages to disk, for small "getimap"-style inbound processing tools.
+package imapfetch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+
+	"github.com/kaey/mail"
+)
+
+// Search narrows down which messages in Mailbox are fetched. Empty fields
+// are not sent as part of the IMAP search criteria.
+type Search struct {
+	From    string
+	To      string
+	Subject string
+	Since   time.Time
+	Before  time.Time
+}
+
+// SaveRule saves Parts whose filename matches Pattern into Dir.
+type SaveRule struct {
+	Pattern *regexp.Regexp
+	Dir     string
+}
+
+// Config describes how to connect to an IMAP server and what to fetch.
+type Config struct {
+	Host string
+	Port int
+	TLS  bool // dial straight into TLS; set false to use plaintext (e.g. behind stunnel)
+
+	Username string
+	Password string
+
+	// Mailbox is the folder to search, e.g. "INBOX".
+	Mailbox string
+
+	Search Search
+
+	// SaveRules, if set, are applied to every Part of every fetched message
+	// in order; the first matching rule's Dir receives the file.
+	SaveRules []SaveRule
+}
+
+// Fetch connects to cfg's server, searches Mailbox and sends every matching
+// message on the returned channel as it's downloaded and parsed. The error
+// channel receives at most one error and is closed, along with the message
+// channel, once fetching is done or ctx is canceled.
+func Fetch(ctx context.Context, cfg Config) (<-chan *mail.Message, <-chan error) {
+	msgs := make(chan *mail.Message)
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(msgs)
+		defer close(errs)
+
+		if err := fetch(ctx, cfg, msgs); err != nil {
+			errs <- err
+		}
+	}()
+
+	return msgs, errs
+}
+
+func fetch(ctx context.Context, cfg Config, msgs chan<- *mail.Message) error {
+	addr := fmt.Sprintf("%v:%v", cfg.Host, cfg.Port)
+
+	var (
+		c   *client.Client
+		err error
+	)
+	if cfg.TLS {
+		c, err = client.DialTLS(addr, &tls.Config{ServerName: cfg.Host})
+	} else {
+		c, err = client.Dial(addr)
+	}
+	if err != nil {
+		return fmt.Errorf("dial: %v", err)
+	}
+	defer c.Logout()
+
+	if err := c.Login(cfg.Username, cfg.Password); err != nil {
+		return fmt.Errorf("login: %v", err)
+	}
+
+	if _, err := c.Select(cfg.Mailbox, true); err != nil {
+		return fmt.Errorf("select %v: %v", cfg.Mailbox, err)
+	}
+
+	uids, err := c.UidSearch(cfg.Search.criteria())
+	if err != nil {
+		return fmt.Errorf("search: %v", err)
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	section := &imap.BodySectionName{Peek: true}
+	fetched := make(chan *imap.Message, 10)
+	fetchErr := make(chan error, 1)
+	go func() {
+		fetchErr <- c.UidFetch(seqset, []imap.FetchItem{section.FetchItem()}, fetched)
+	}()
+
+	for raw := range fetched {
+		lit := raw.GetBody(section)
+		if lit == nil {
+			continue
+		}
+		m, err := mail.ReadMessage(lit)
+		if err != nil {
+			drainFetch(fetched, fetchErr)
+			return fmt.Errorf("parse message %v: %v", raw.Uid, err)
+		}
+
+		if err := cfg.saveParts(m); err != nil {
+			drainFetch(fetched, fetchErr)
+			return err
+		}
+
+		select {
+		case msgs <- m:
+		case <-ctx.Done():
+			drainFetch(fetched, fetchErr)
+			return ctx.Err()
+		}
+	}
+
+	return <-fetchErr
+}
+
+// drainFetch discards any remaining messages on fetched and waits for the
+// UidFetch goroutine feeding it to finish, by reading its result off
+// fetchErr. Callers must do this before returning early from fetch's
+// consumer loop: c's deferred Logout isn't safe to issue while that
+// goroutine is still mid-command on the same connection.
+func drainFetch(fetched <-chan *imap.Message, fetchErr <-chan error) {
+	for range fetched {
+	}
+	<-fetchErr
+}
+
+// criteria builds the IMAP search criteria for s. Zero-value fields are
+// omitted, matching any message.
+func (s Search) criteria() *imap.SearchCriteria {
+	c := imap.NewSearchCriteria()
+	c.Header = make(map[string][]string)
+	if s.From != "" {
+		c.Header.Set("From", s.From)
+	}
+	if s.To != "" {
+		c.Header.Set("To", s.To)
+	}
+	if s.Subject != "" {
+		c.Header.Set("Subject", s.Subject)
+	}
+	c.SentSince = s.Since
+	c.SentBefore = s.Before
+	return c
+}
+
+// saveParts writes every Part of m matching a SaveRule to that rule's Dir.
+func (cfg Config) saveParts(m *mail.Message) error {
+	for _, p := range m.Parts {
+		for _, rule := range cfg.SaveRules {
+			if !rule.Pattern.MatchString(p.Name) {
+				continue
+			}
+			if err := savePart(p, filepath.Join(rule.Dir, filepath.Base(p.Name))); err != nil {
+				return fmt.Errorf("save part %v: %v", p.Name, err)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// savePart writes p's contents to path, regardless of whether p was kept in
+// memory or spilled to a tempfile while parsing.
+func savePart(p mail.Part, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := p.Open()
+	defer r.Close()
+
+	_, err = io.Copy(f, r)
+	return err
+}
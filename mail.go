@@ -44,7 +44,6 @@ import (
 	"mime/multipart"
 	"mime/quotedprintable"
 	"net/mail"
-	"net/smtp"
 	"net/textproto"
 	"os"
 	"strings"
@@ -53,17 +52,15 @@ import (
 
 	"golang.org/x/net/html/charset"
 	"golang.org/x/text/transform"
-
-	"github.com/jaytaylor/html2text"
 )
 
 // Message represents an email message.
 type Message struct {
 	ID         string
-	ReturnPath string
-	From       string
-	To         []string
-	CC         []string
+	ReturnPath Address
+	From       Address
+	To         []Address
+	CC         []Address
 	Subject    string
 	Date       time.Time
 	// IsHTML is set when Body contains HTML converted to text.
@@ -73,22 +70,73 @@ type Message struct {
 	Body    string
 	Parts   []Part
 	Headers map[string]string
+
+	// DKIM, if set, signs the message in SendVia.
+	DKIM *DKIMSigner
+
+	// raw holds the exact bytes ReadMessage parsed m from, so VerifyDKIM can
+	// re-canonicalize the real wire format rather than a reconstruction of
+	// it. Unset on messages built with NewMessage.
+	raw []byte
 }
 
 // Part represents attachment in message.
+//
+// A Part holds its data either in Data or, once ReadMessageOptions.SpillThreshold
+// is exceeded while parsing, behind Reader; exactly one of the two is set.
+// Open returns a reader over either form, so callers don't need to branch on
+// which one was used.
 type Part struct {
-	Name string
-	Data []byte
+	Name   string
+	Data   []byte
+	Reader io.ReadCloser
+}
+
+// Open returns a reader over p's contents, uniformly over Data and Reader.
+// Closing it is always safe; for a Reader-backed Part it releases the
+// underlying tempfile.
+func (p Part) Open() io.ReadCloser {
+	if p.Reader != nil {
+		return p.Reader
+	}
+	return ioutil.NopCloser(bytes.NewReader(p.Data))
+}
+
+// closeParts releases any spilled tempfiles already attached to m.Parts.
+// Callers must use this when discarding a partially decoded Message, since
+// nothing else removes a Part's spillFile once decodeBody has created it.
+func (m *Message) closeParts() {
+	for _, p := range m.Parts {
+		if p.Reader != nil {
+			p.Reader.Close()
+		}
+	}
+}
+
+// Address represents a mail address with an optional display name, e.g. the
+// "John Doe" in "John Doe <john@example.com>".
+type Address struct {
+	Name  string
+	Email string
+}
+
+// String formats a as "Name <email>", or just the bare email when Name is
+// empty.
+func (a Address) String() string {
+	if a.Name == "" {
+		return a.Email
+	}
+	return (&mail.Address{Name: a.Name, Address: a.Email}).String()
 }
 
 // NewMessage creates new message.
 func NewMessage(from string, to []string, cc []string, subject, body string, headers map[string]string) *Message {
 	return &Message{
 		ID:         makeID(),
-		ReturnPath: from,
-		From:       from,
-		To:         to,
-		CC:         cc,
+		ReturnPath: Address{Email: from},
+		From:       Address{Email: from},
+		To:         addressList(to),
+		CC:         addressList(cc),
 		Subject:    subject,
 		Date:       time.Now(),
 		Body:       body,
@@ -96,10 +144,38 @@ func NewMessage(from string, to []string, cc []string, subject, body string, hea
 	}
 }
 
-// ReadMessage reads message from r.
+// addressList wraps bare email addresses as Addresses with no display name.
+func addressList(emails []string) []Address {
+	addrs := make([]Address, len(emails))
+	for i, e := range emails {
+		addrs[i] = Address{Email: e}
+	}
+	return addrs
+}
+
+// ReadMessage reads message from r, applying the default ReadMessageOptions.
 // Using Send() on read messages can result in garbage in headers,
 // make sure to remove unnecessary ones, before sending.
 func ReadMessage(r io.Reader) (*Message, error) {
+	return ReadMessageWithOptions(r, ReadMessageOptions{})
+}
+
+// ReadMessageWithOptions reads message from r like ReadMessage, but bounds
+// memory use and recursion according to opts. This is the entry point to use
+// on untrusted mail streams, where a message may carry a multi-hundred-MiB
+// attachment or a deeply nested multipart bomb.
+func ReadMessageWithOptions(r io.Reader, opts ReadMessageOptions) (*Message, error) {
+	opts = opts.withDefaults()
+
+	raw := new(bytes.Buffer)
+	r = io.TeeReader(r, raw)
+
+	var cr *countingReader
+	if opts.MaxMessageSize >= 0 {
+		cr = &countingReader{r: r}
+		r = io.LimitReader(cr, opts.MaxMessageSize+1)
+	}
+
 	rawmsg, err := mail.ReadMessage(r)
 	if err != nil {
 		return nil, err
@@ -132,7 +208,7 @@ func ReadMessage(r io.Reader) (*Message, error) {
 
 	// Return-Path
 	if h := rawmsg.Header.Get("Return-Path"); h != "" {
-		retpath, err := DecodeAddress(h)
+		retpath, err := ParseAddressList(h)
 		if err != nil {
 			return nil, fmt.Errorf("parse return-path: %v", err)
 		}
@@ -143,7 +219,7 @@ func ReadMessage(r io.Reader) (*Message, error) {
 
 	// From
 	if h := rawmsg.Header.Get("From"); h != "" {
-		from, err := DecodeAddress(h)
+		from, err := ParseAddressList(h)
 		if err != nil {
 			return nil, fmt.Errorf("parse from: %v", err)
 		}
@@ -154,28 +230,28 @@ func ReadMessage(r io.Reader) (*Message, error) {
 
 	// To
 	if h := rawmsg.Header.Get("To"); h != "" {
-		to, err := DecodeAddress(h)
+		to, err := ParseAddressList(h)
 		if err != nil {
 			return nil, fmt.Errorf("parse to: %v", err)
 		}
 		m.To = to
 	} else {
-		m.To = make([]string, 0)
+		m.To = make([]Address, 0)
 	}
 
 	// CC
 	if h := rawmsg.Header.Get("Cc"); h != "" {
-		cc, err := DecodeAddress(h)
+		cc, err := ParseAddressList(h)
 		if err != nil {
 			return nil, fmt.Errorf("parse cc: %v", err)
 		}
 		m.CC = cc
 	} else {
-		m.CC = make([]string, 0)
+		m.CC = make([]Address, 0)
 	}
 
 	// If return-path is unset, set it using from.
-	if m.ReturnPath == "" {
+	if m.ReturnPath.Email == "" {
 		m.ReturnPath = m.From
 	}
 
@@ -201,18 +277,30 @@ func ReadMessage(r io.Reader) (*Message, error) {
 	m.Headers = headers
 
 	// Decode body.
-	if err := m.decodeBody(rawmsg.Body, textproto.MIMEHeader(rawmsg.Header)); err != nil {
+	st := &parseState{opts: opts}
+	if err := m.decodeBody(rawmsg.Body, textproto.MIMEHeader(rawmsg.Header), st); err != nil {
+		m.closeParts()
 		return nil, fmt.Errorf("decode body: %v", err)
 	}
 
+	if cr != nil && cr.n > opts.MaxMessageSize {
+		m.closeParts()
+		return nil, fmt.Errorf("message exceeds MaxMessageSize (%v bytes)", opts.MaxMessageSize)
+	}
+
 	if len(m.HTML) > 0 {
-		m.Body, err = html2text.FromString(m.HTML)
-		if err != nil {
-			return nil, err
+		if m.Body == "" {
+			m.Body, err = opts.HTMLConverter.Convert(m.HTML)
+			if err != nil {
+				m.closeParts()
+				return nil, err
+			}
+			m.IsHTML = true
 		}
-		m.IsHTML = true
 	}
 
+	m.raw = raw.Bytes()
+
 	return m, nil
 }
 
@@ -238,7 +326,7 @@ func (m *Message) Reply(from, body string, cc []string) *Message {
 		nbody.WriteString("\n")
 	}
 
-	return NewMessage(from, []string{m.ReturnPath}, cc, subj, nbody.String(), headers)
+	return NewMessage(from, []string{m.ReturnPath.Email}, cc, subj, nbody.String(), headers)
 }
 
 // ReplyAll generates reply all to m.
@@ -248,22 +336,22 @@ func (m *Message) ReplyAll(from, body string) *Message {
 		seen = make(map[string]bool)
 	)
 
-	if m.ReturnPath != m.From {
-		cc = append(cc, m.From)
-		seen[m.From] = true
+	if m.ReturnPath.Email != m.From.Email {
+		cc = append(cc, m.From.Email)
+		seen[m.From.Email] = true
 	}
 
 	for _, v := range m.To {
-		if _, exists := seen[v]; !exists {
-			cc = append(cc, v)
-			seen[v] = true
+		if _, exists := seen[v.Email]; !exists {
+			cc = append(cc, v.Email)
+			seen[v.Email] = true
 		}
 	}
 
 	for _, v := range m.CC {
-		if _, exists := seen[v]; !exists {
-			cc = append(cc, v)
-			seen[v] = true
+		if _, exists := seen[v.Email]; !exists {
+			cc = append(cc, v.Email)
+			seen[v.Email] = true
 		}
 	}
 
@@ -290,31 +378,25 @@ func (m *Message) Forward(from string, to []string, cc []string, body string) *M
 	return NewMessage(from, to, cc, subj, nbody.String(), headers)
 }
 
-// Send sends message via 127.0.0.1:25.
-func (m *Message) Send() error {
-	b, err := m.Marshal()
-	if err != nil {
-		return fmt.Errorf("marshal body: %v", err)
-	}
-	var recv []string
-	recv = append(recv, m.To...)
-	recv = append(recv, m.CC...)
-	return smtp.SendMail("127.0.0.1:25", nil, m.From, recv, b)
-}
-
-// Marshal builds a textual representation of a message with headers and quoted-printable body.
-// It ignores ReturnPath, HTML and Parts.
+// Marshal builds a textual representation of a message with headers and body.
+// It ignores ReturnPath.
+//
+// When both Body and HTML are set, the body is emitted as multipart/alternative
+// so mail readers can pick whichever representation they prefer. When Parts is
+// non-empty, that (possibly multipart/alternative) body is wrapped in
+// multipart/mixed with each Part attached as base64, which mirrors what
+// decodeBody understands on the way in.
 func (m *Message) Marshal() ([]byte, error) {
 	q := mime.QEncoding
 	buf := new(bytes.Buffer)
-	buf.WriteString(fmt.Sprintf("From: <%v>\n", m.From))
+	buf.WriteString(fmt.Sprintf("From: %v\n", m.From))
 	if len(m.To) > 0 {
 		buf.WriteString("To: ")
 		for i, v := range m.To {
 			if i != 0 {
 				buf.WriteString(", ")
 			}
-			buf.WriteString(fmt.Sprintf("<%v>", v))
+			buf.WriteString(v.String())
 		}
 		buf.WriteString("\n")
 	}
@@ -324,7 +406,7 @@ func (m *Message) Marshal() ([]byte, error) {
 			if i != 0 {
 				buf.WriteString(", ")
 			}
-			buf.WriteString(fmt.Sprintf("<%v>", v))
+			buf.WriteString(v.String())
 		}
 		buf.WriteString("\n")
 	}
@@ -338,36 +420,178 @@ func (m *Message) Marshal() ([]byte, error) {
 		}
 		buf.WriteString(fmt.Sprintf("%v: %v\n", k, q.Encode("utf-8", v)))
 	}
-	if m.IsHTML {
-		buf.WriteString("Content-Type: text/html; charset=utf-8;\n")
-	} else {
-		buf.WriteString("Content-Type: text/plain; charset=utf-8;\n")
+
+	body := new(bytes.Buffer)
+	ct, cte, err := m.marshalBody(body)
+	if err != nil {
+		return nil, err
 	}
 
-	buf.WriteString("Content-Transfer-Encoding: quoted-printable\n")
+	buf.WriteString("MIME-Version: 1.0\n")
+	buf.WriteString(fmt.Sprintf("Content-Type: %v\n", ct))
+	if cte != "" {
+		buf.WriteString(fmt.Sprintf("Content-Transfer-Encoding: %v\n", cte))
+	}
 	buf.WriteString("\n")
+	buf.Write(body.Bytes())
 
-	w := quotedprintable.NewWriter(buf)
-	if _, err := w.Write([]byte(m.Body)); err != nil {
-		return nil, err
+	return buf.Bytes(), nil
+}
+
+// marshalBody writes the MIME body of m to w, returning the Content-Type
+// (and, for a single leaf part, Content-Transfer-Encoding) the caller should
+// put in the message header.
+func (m *Message) marshalBody(w io.Writer) (ct, cte string, err error) {
+	if len(m.Parts) > 0 {
+		altCT, altCTE, altBody, err := m.marshalAltBody()
+		if err != nil {
+			return "", "", err
+		}
+
+		mw := multipart.NewWriter(w)
+		header := textproto.MIMEHeader{"Content-Type": {altCT}}
+		if altCTE != "" {
+			header.Set("Content-Transfer-Encoding", altCTE)
+		}
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := pw.Write(altBody); err != nil {
+			return "", "", err
+		}
+		for _, p := range m.Parts {
+			if err := writeAttachmentPart(mw, p); err != nil {
+				return "", "", err
+			}
+		}
+		if err := mw.Close(); err != nil {
+			return "", "", err
+		}
+		return fmt.Sprintf("multipart/mixed; boundary=%q", mw.Boundary()), "", nil
 	}
-	if err := w.Close(); err != nil {
-		return nil, err
+
+	ct, cte, body, err := m.marshalAltBody()
+	if err != nil {
+		return "", "", err
 	}
+	if _, err := w.Write(body); err != nil {
+		return "", "", err
+	}
+	return ct, cte, nil
+}
 
-	return buf.Bytes(), nil
+// marshalAltBody renders m.Body and/or m.HTML, returning the Content-Type
+// (multipart/alternative with its own boundary if both are set, otherwise
+// text/plain or text/html), the Content-Transfer-Encoding for the latter
+// case, and the rendered bytes.
+func (m *Message) marshalAltBody() (ct, cte string, body []byte, err error) {
+	if m.Body != "" && m.HTML != "" {
+		buf := new(bytes.Buffer)
+		mw := multipart.NewWriter(buf)
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/plain; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", "", nil, err
+		}
+		if err := writeQuotedPrintable(pw, m.Body); err != nil {
+			return "", "", nil, err
+		}
+		pw, err = mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {"text/html; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", "", nil, err
+		}
+		if err := writeQuotedPrintable(pw, m.HTML); err != nil {
+			return "", "", nil, err
+		}
+		if err := mw.Close(); err != nil {
+			return "", "", nil, err
+		}
+		return fmt.Sprintf("multipart/alternative; boundary=%q", mw.Boundary()), "", buf.Bytes(), nil
+	}
+
+	buf := new(bytes.Buffer)
+	if m.HTML != "" {
+		if err := writeQuotedPrintable(buf, m.HTML); err != nil {
+			return "", "", nil, err
+		}
+		return "text/html; charset=utf-8", "quoted-printable", buf.Bytes(), nil
+	}
+
+	// HTML is unset: honor IsHTML so a message built with Body holding raw
+	// HTML markup still marshals as text/html instead of text/plain.
+	if m.IsHTML {
+		if err := writeQuotedPrintable(buf, m.Body); err != nil {
+			return "", "", nil, err
+		}
+		return "text/html; charset=utf-8", "quoted-printable", buf.Bytes(), nil
+	}
+
+	if err := writeQuotedPrintable(buf, m.Body); err != nil {
+		return "", "", nil, err
+	}
+	return "text/plain; charset=utf-8", "quoted-printable", buf.Bytes(), nil
+}
+
+// writeAttachmentPart serializes p as a base64 multipart attachment,
+// RFC 2231 encoding the filename when it isn't plain ASCII.
+func writeAttachmentPart(mw *multipart.Writer, p Part) error {
+	cd := mime.FormatMediaType("attachment", map[string]string{"filename": p.Name})
+	if cd == "" {
+		cd = "attachment"
+	}
+	ct := mime.FormatMediaType("application/octet-stream", map[string]string{"name": p.Name})
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	pw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {ct},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {cd},
+	})
+	if err != nil {
+		return err
+	}
+
+	r := p.Open()
+	defer r.Close()
+
+	enc := base64.NewEncoder(base64.StdEncoding, pw)
+	if _, err := io.Copy(enc, r); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// writeQuotedPrintable encodes s as quoted-printable to w.
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qw := quotedprintable.NewWriter(w)
+	if _, err := qw.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qw.Close()
 }
 
 // Receivers return joined list from To and CC separated with comma.
 func (m *Message) Receivers() string {
 	var recv []string
-	recv = append(recv, m.To...)
-	recv = append(recv, m.CC...)
+	for _, v := range m.To {
+		recv = append(recv, v.String())
+	}
+	for _, v := range m.CC {
+		recv = append(recv, v.String())
+	}
 	return strings.Join(recv, ", ")
 }
 
 // decodeBody parses body of a message, filling m.Body, m.HTML and m.Parts.
-func (m *Message) decodeBody(r io.Reader, h textproto.MIMEHeader) error {
+// st bounds recursion depth, part count, and per-part size, per opts.
+func (m *Message) decodeBody(r io.Reader, h textproto.MIMEHeader, st *parseState) error {
 	cth := h.Get("Content-Type")
 	if cth == "" {
 		cth = "text/plain"
@@ -393,31 +617,41 @@ func (m *Message) decodeBody(r io.Reader, h textproto.MIMEHeader) error {
 
 	// If it has filename, add as attachment.
 	if filename != "" {
+		if err := st.addPart(); err != nil {
+			return err
+		}
+
 		name, err := decodeHeader(filename)
 		if err != nil {
 			return fmt.Errorf("decode filename: %v", err)
 		}
-		data, err := ioutil.ReadAll(decodeTransfer(r, h.Get("Content-Transfer-Encoding")))
+		data, rc, err := readPart(decodeTransfer(r, h.Get("Content-Transfer-Encoding")), st)
 		if err != nil {
 			return fmt.Errorf("read attachment: %v", err)
 		}
 
-		m.Parts = append(m.Parts, Part{Name: name, Data: data})
+		m.Parts = append(m.Parts, Part{Name: name, Data: data, Reader: rc})
 		return nil
 	}
 
 	if ct == "text/plain" || ct == "text/html" {
+		if err := st.addPart(); err != nil {
+			return err
+		}
+
+		tr := decodeTransfer(r, h.Get("Content-Transfer-Encoding"))
+		if st.opts.MaxPartSize >= 0 {
+			tr = io.LimitReader(tr, st.opts.MaxPartSize+1)
+		}
+
 		buf := new(bytes.Buffer)
-		for {
-			data, err := ioutil.ReadAll(decodeTransfer(r, h.Get("Content-Transfer-Encoding")))
-			buf.Write(data)
-			if err != nil {
-				if _, ok := err.(base64.CorruptInputError); ok {
-					continue
-				}
-				return fmt.Errorf("read body: %v", err)
-			}
-			break
+		data, err := ioutil.ReadAll(tr)
+		buf.Write(data)
+		if err != nil {
+			return fmt.Errorf("read body: %v", err)
+		}
+		if st.opts.MaxPartSize >= 0 && int64(buf.Len()) > st.opts.MaxPartSize {
+			return fmt.Errorf("part exceeds MaxPartSize (%v bytes)", st.opts.MaxPartSize)
 		}
 
 		body, err := decodeCharset(buf.String(), ctp["charset"])
@@ -435,6 +669,11 @@ func (m *Message) decodeBody(r io.Reader, h textproto.MIMEHeader) error {
 	}
 
 	if strings.HasPrefix(ct, "multipart/") {
+		if err := st.descend(); err != nil {
+			return err
+		}
+		defer st.ascend()
+
 		r := multipart.NewReader(r, ctp["boundary"])
 		for {
 			p, err := r.NextPart()
@@ -445,7 +684,7 @@ func (m *Message) decodeBody(r io.Reader, h textproto.MIMEHeader) error {
 				return fmt.Errorf("next part: %q", err)
 			}
 
-			if err := m.decodeBody(p, p.Header); err != nil {
+			if err := m.decodeBody(p, p.Header, st); err != nil {
 				p.Close() // p.Close is also called automatically by r.NextPart.
 				return err
 			}
@@ -458,54 +697,43 @@ func (m *Message) decodeBody(r io.Reader, h textproto.MIMEHeader) error {
 	return nil
 }
 
-// DecodeAddress parses address line.
-func DecodeAddress(rawheader string) ([]string, error) {
+// ParseAddressList parses a comma-separated address header field such as
+// From, To or Cc, via net/mail's AddressParser. Unlike a naive split on
+// commas, this correctly handles quoted display names containing commas
+// (`"Doe, John" <j@x>`), RFC 5322 group syntax (`undisclosed-recipients:;`)
+// and comments, and decodes RFC 2047 encoded-words in display names.
+func ParseAddressList(rawheader string) ([]Address, error) {
 	if rawheader == "" {
 		return nil, nil
 	}
 
-	header, err := decodeHeader(rawheader)
+	ap := &mail.AddressParser{WordDecoder: &mime.WordDecoder{CharsetReader: charset.NewReaderLabel}}
+	list, err := ap.ParseList(rawheader)
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		addrs []string
-		buf   bytes.Buffer
-		state = "outside"
-	)
-	for _, v := range header {
-		switch state {
-		case "outside":
-			if v == '>' {
-				continue
-			}
-			if v == '<' {
-				state = "inside"
-				continue
-			}
-		case "inside":
-			if v == '<' {
-				buf.Reset()
-				continue
-			}
-			if v == '>' {
-				addrs = append(addrs, buf.String())
-				buf.Reset()
-				state = "outside"
-				continue
-			}
-			buf.WriteRune(v)
-		}
+	addrs := make([]Address, len(list))
+	for i, a := range list {
+		addrs[i] = Address{Name: a.Name, Email: a.Address}
 	}
+	return addrs, nil
+}
 
-	// If no addresses in angular brackets found, split by comma.
-	if len(addrs) == 0 {
-		header = strings.Replace(header, " ", "", -1)
-		return strings.Split(header, ","), nil
+// DecodeAddress parses address line, returning the bare email addresses.
+// It's a thin wrapper around ParseAddressList for callers that don't need
+// display names.
+func DecodeAddress(rawheader string) ([]string, error) {
+	list, err := ParseAddressList(rawheader)
+	if err != nil {
+		return nil, err
 	}
 
-	return addrs, nil
+	emails := make([]string, len(list))
+	for i, a := range list {
+		emails[i] = a.Email
+	}
+	return emails, nil
 }
 
 // decodeHeader decodes header, detecting its charset.
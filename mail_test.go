@@ -0,0 +1,66 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestMarshalReadMessageRoundTrip(t *testing.T) {
+	m := NewMessage("from@x.com", []string{"to@x.com"}, nil, "subject", "hello world", nil)
+	m.HTML = "<p>hello world</p>"
+	m.Parts = []Part{{Name: "note.txt", Data: []byte("attachment data")}}
+
+	raw, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !bytes.Contains(raw, []byte("MIME-Version: 1.0\n")) {
+		t.Error("Marshal didn't emit MIME-Version: 1.0")
+	}
+
+	got, err := ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if got.Subject != m.Subject {
+		t.Errorf("Subject = %q, want %q", got.Subject, m.Subject)
+	}
+	if got.Body != m.Body {
+		t.Errorf("Body = %q, want %q", got.Body, m.Body)
+	}
+	if got.HTML != m.HTML {
+		t.Errorf("HTML = %q, want %q", got.HTML, m.HTML)
+	}
+	if len(got.Parts) != 1 {
+		t.Fatalf("got %v parts, want 1", len(got.Parts))
+	}
+	data, err := ioutil.ReadAll(got.Parts[0].Open())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "attachment data" {
+		t.Errorf("part data = %q, want %q", data, "attachment data")
+	}
+	if got.Parts[0].Name != "note.txt" {
+		t.Errorf("part name = %q, want %q", got.Parts[0].Name, "note.txt")
+	}
+}
+
+func TestMarshalIsHTMLFallback(t *testing.T) {
+	m := NewMessage("from@x.com", []string{"to@x.com"}, nil, "subject", "<p>hi</p>", nil)
+	m.IsHTML = true
+
+	raw, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	if !strings.Contains(string(raw), "Content-Type: text/html") {
+		t.Errorf("Marshal of an IsHTML message with no HTML set didn't use text/html:\n%s", raw)
+	}
+}
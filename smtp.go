@@ -0,0 +1,225 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+)
+
+// Sender delivers a marshaled message to a transport of the caller's choosing.
+// SMTPTransport is the only implementation provided by this package, but
+// anything satisfying this interface can be passed to Message.SendVia.
+type Sender interface {
+	Send(ctx context.Context, from string, to []string, msg []byte) error
+}
+
+// TLSMode selects how SMTPTransport secures its connection.
+type TLSMode int
+
+const (
+	// TLSNone sends the message over a plaintext connection.
+	TLSNone TLSMode = iota
+	// TLSStartTLS upgrades a plaintext connection with STARTTLS, as used on
+	// the submission port 587.
+	TLSStartTLS
+	// TLSImplicit dials straight into TLS, as used on port 465.
+	TLSImplicit
+)
+
+// SMTPTransport sends messages via SMTP, with support for TLS, auth and
+// submission servers. Message.Send uses one with neither TLS nor auth;
+// Message.SendVia takes one configured by the caller.
+type SMTPTransport struct {
+	Host string
+	Port int
+
+	// Auth authenticates the session once connected, e.g. smtp.PlainAuth,
+	// smtp.CRAMMD5Auth or LoginAuth. Left nil, no AUTH command is sent.
+	Auth smtp.Auth
+
+	TLSMode   TLSMode
+	TLSConfig *tls.Config // defaults to &tls.Config{ServerName: Host} when nil
+
+	// LocalName is used in the EHLO/HELO greeting. Defaults to "localhost".
+	LocalName string
+}
+
+// Send implements Sender.
+func (t *SMTPTransport) Send(ctx context.Context, from string, to []string, msg []byte) error {
+	c, err := t.dial(ctx)
+	if err != nil {
+		return fmt.Errorf("dial: %v", err)
+	}
+	defer c.Close()
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("mail from: %v", err)
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return fmt.Errorf("rcpt to %v: %v", addr, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("data: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("write data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("close data: %v", err)
+	}
+
+	return c.Quit()
+}
+
+// dial connects to the server, negotiates STARTTLS/auth and returns a ready
+// to use *smtp.Client. The caller is responsible for closing it.
+func (t *SMTPTransport) dial(ctx context.Context) (*smtp.Client, error) {
+	addr := fmt.Sprintf("%v:%v", t.Host, t.Port)
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if t.TLSMode == TLSImplicit {
+		d := tls.Dialer{NetDialer: &net.Dialer{}, Config: t.tlsConfig()}
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := smtp.NewClient(conn, t.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	localName := t.LocalName
+	if localName == "" {
+		localName = "localhost"
+	}
+	if err := c.Hello(localName); err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if t.TLSMode == TLSStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("server does not support STARTTLS")
+		}
+		if err := c.StartTLS(t.tlsConfig()); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	if t.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			c.Close()
+			return nil, fmt.Errorf("server does not support AUTH")
+		}
+		if err := c.Auth(t.Auth); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (t *SMTPTransport) tlsConfig() *tls.Config {
+	if t.TLSConfig != nil {
+		return t.TLSConfig
+	}
+	return &tls.Config{ServerName: t.Host}
+}
+
+// loginAuth implements the LOGIN authentication mechanism, which net/smtp
+// doesn't provide alongside PlainAuth and CRAMMD5Auth.
+type loginAuth struct {
+	username, password string
+}
+
+// LoginAuth returns an smtp.Auth implementing the LOGIN mechanism.
+func LoginAuth(username, password string) smtp.Auth {
+	return &loginAuth{username, password}
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.username), nil
+	case "Password:":
+		return []byte(a.password), nil
+	default:
+		return nil, fmt.Errorf("unknown LOGIN challenge: %q", fromServer)
+	}
+}
+
+// SendVia marshals m, signs it with m.DKIM if set, and delivers it through t.
+func (m *Message) SendVia(ctx context.Context, t Sender) error {
+	b, err := m.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal body: %v", err)
+	}
+
+	if m.DKIM != nil {
+		signed := new(bytes.Buffer)
+		if err := m.DKIM.Sign(signed, b); err != nil {
+			return fmt.Errorf("dkim sign: %v", err)
+		}
+		b = signed.Bytes()
+	}
+
+	var recv []string
+	for _, v := range m.To {
+		recv = append(recv, v.Email)
+	}
+	for _, v := range m.CC {
+		recv = append(recv, v.Email)
+	}
+
+	return t.Send(ctx, m.From.Email, recv, b)
+}
+
+// Send sends message via the SMTP server named by MAIL_SMTP_HOST/
+// MAIL_SMTP_PORT (127.0.0.1:25 by default), without TLS or auth.
+// Use SendVia with a configured SMTPTransport to reach a real submission
+// server.
+func (m *Message) Send() error {
+	host := os.Getenv("MAIL_SMTP_HOST")
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	port := 25
+	if v := os.Getenv("MAIL_SMTP_PORT"); v != "" {
+		if p, err := strconv.Atoi(v); err == nil {
+			port = p
+		}
+	}
+
+	return m.SendVia(context.Background(), &SMTPTransport{Host: host, Port: port})
+}
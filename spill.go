@@ -0,0 +1,198 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// Defaults applied by ReadMessageOptions.withDefaults when the corresponding
+// field is left at its zero value.
+const (
+	DefaultSpillThreshold = 1 << 20 // 1 MiB
+	DefaultMaxPartSize    = 25 << 20
+	DefaultMaxMessageSize = 50 << 20
+	DefaultMaxPartCount   = 1000
+	DefaultMaxDepth       = 16
+)
+
+// ReadMessageOptions bounds how much memory and recursion ReadMessageWithOptions
+// spends on a single message, so a 500 MiB attachment or a deeply nested
+// multipart bomb can't take a caller's process down with it.
+type ReadMessageOptions struct {
+	// MaxMessageSize caps the total size of the raw message. 0 uses
+	// DefaultMaxMessageSize; negative means unlimited.
+	MaxMessageSize int64
+	// MaxPartSize caps the decoded size of any single leaf part (body or
+	// attachment). 0 uses DefaultMaxPartSize; negative means unlimited.
+	MaxPartSize int64
+	// MaxPartCount caps the number of parts (attachments plus text/html
+	// leaves) a message may contain. 0 uses DefaultMaxPartCount.
+	MaxPartCount int
+	// MaxDepth caps multipart nesting depth. 0 uses DefaultMaxDepth.
+	MaxDepth int
+
+	// SpillThreshold is the decoded size, in bytes, above which a Part's
+	// data is written to a tempfile instead of being held in memory as
+	// Part.Data. 0 uses DefaultSpillThreshold; negative disables spilling.
+	SpillThreshold int64
+	// SpillDir is the directory spilled parts are created in. Empty uses
+	// os.TempDir().
+	SpillDir string
+
+	// HTMLConverter derives Body from HTML when the message has no separate
+	// text/plain alternative. Nil uses HTML2Text, matching ReadMessage's
+	// long-standing behavior. m.HTML is always populated regardless of this
+	// setting.
+	HTMLConverter HTMLConverter
+}
+
+func (o ReadMessageOptions) withDefaults() ReadMessageOptions {
+	if o.MaxMessageSize == 0 {
+		o.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if o.MaxPartSize == 0 {
+		o.MaxPartSize = DefaultMaxPartSize
+	}
+	if o.MaxPartCount == 0 {
+		o.MaxPartCount = DefaultMaxPartCount
+	}
+	if o.MaxDepth == 0 {
+		o.MaxDepth = DefaultMaxDepth
+	}
+	if o.SpillThreshold == 0 {
+		o.SpillThreshold = DefaultSpillThreshold
+	}
+	if o.HTMLConverter == nil {
+		o.HTMLConverter = HTML2Text
+	}
+	return o
+}
+
+// parseState carries the per-message bookkeeping decodeBody needs to enforce
+// ReadMessageOptions across recursive multipart calls.
+type parseState struct {
+	opts  ReadMessageOptions
+	depth int
+	parts int
+}
+
+// addPart counts a leaf part (attachment or text/html body), failing once
+// MaxPartCount is exceeded.
+func (st *parseState) addPart() error {
+	st.parts++
+	if st.parts > st.opts.MaxPartCount {
+		return fmt.Errorf("message exceeds MaxPartCount (%v)", st.opts.MaxPartCount)
+	}
+	return nil
+}
+
+// descend enters a nested multipart part, failing once MaxDepth is exceeded.
+func (st *parseState) descend() error {
+	st.depth++
+	if st.depth > st.opts.MaxDepth {
+		return fmt.Errorf("message exceeds MaxDepth (%v)", st.opts.MaxDepth)
+	}
+	return nil
+}
+
+// ascend leaves a nested multipart part entered via descend.
+func (st *parseState) ascend() {
+	st.depth--
+}
+
+// countingReader counts the bytes read through it, so the caller can tell
+// after the fact whether a size limit placed on it (e.g. via io.LimitReader)
+// was actually hit rather than the stream legitimately ending at the limit.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// spillFile deletes its underlying file on Close, so a spilled Part doesn't
+// leak a tempfile once the caller is done reading it.
+type spillFile struct {
+	*os.File
+}
+
+func (f spillFile) Close() error {
+	name := f.Name()
+	err := f.File.Close()
+	if rmErr := os.Remove(name); err == nil {
+		err = rmErr
+	}
+	return err
+}
+
+// readPart reads a decoded leaf part from r, honoring st's MaxPartSize. Parts
+// at or under SpillThreshold are returned in data; larger ones are spilled to
+// a tempfile under SpillDir and returned via rc instead, with the data read
+// so far rewound to its front.
+func readPart(r io.Reader, st *parseState) (data []byte, rc io.ReadCloser, err error) {
+	max := st.opts.MaxPartSize
+	if max >= 0 {
+		r = io.LimitReader(r, max+1)
+	}
+
+	threshold := st.opts.SpillThreshold
+	if threshold < 0 {
+		data, err = ioutil.ReadAll(r)
+		return data, nil, checkPartSize(int64(len(data)), max, err)
+	}
+
+	buf := make([]byte, threshold+1)
+	n, err := io.ReadFull(r, buf)
+	switch err {
+	case io.ErrUnexpectedEOF, io.EOF:
+		return buf[:n], nil, checkPartSize(int64(n), max, nil)
+	case nil:
+		// Buffer filled; more data follows, so spill the rest to disk.
+	default:
+		return nil, nil, err
+	}
+
+	f, err := ioutil.TempFile(st.opts.SpillDir, "mail-part-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("spill part: %v", err)
+	}
+	if _, err := f.Write(buf[:n]); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, fmt.Errorf("spill part: %v", err)
+	}
+	written, err := io.Copy(f, r)
+	written += int64(n)
+	if err == nil {
+		err = checkPartSize(written, max, nil)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+
+	return nil, spillFile{f}, nil
+}
+
+func checkPartSize(n, max int64, err error) error {
+	if max >= 0 && n > max {
+		return fmt.Errorf("part exceeds MaxPartSize (%v bytes)", max)
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+// Copyright 2015 Konstantin Kulikov. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package mail
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// TestReadMessageWithOptionsSpillCleanup covers the interaction between
+// SpillThreshold and MaxMessageSize: a part spilled to a tempfile while
+// decodeBody runs must still be cleaned up if the message is later rejected
+// for exceeding MaxMessageSize.
+func TestReadMessageWithOptionsSpillCleanup(t *testing.T) {
+	dir := t.TempDir()
+
+	m := NewMessage("from@x.com", []string{"to@x.com"}, nil, "subject", "body", nil)
+	m.Parts = []Part{{Name: "big.bin", Data: bytes.Repeat([]byte("a"), 4096)}}
+
+	raw, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	opts := ReadMessageOptions{
+		SpillDir:       dir,
+		SpillThreshold: 10, // force the attachment to spill
+		MaxMessageSize: int64(len(raw)) - 1,
+	}
+
+	if _, err := ReadMessageWithOptions(bytes.NewReader(raw), opts); err == nil {
+		t.Fatal("expected MaxMessageSize error, got nil")
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("spilled tempfile(s) left behind in %v: %v", dir, entries)
+	}
+}
+
+// TestReadMessageWithOptionsSpill covers the success path: a part over
+// SpillThreshold is spilled to disk and still readable via Part.Open, and
+// its tempfile is removed once the Part is closed.
+func TestReadMessageWithOptionsSpill(t *testing.T) {
+	dir := t.TempDir()
+
+	want := bytes.Repeat([]byte("b"), 4096)
+	m := NewMessage("from@x.com", []string{"to@x.com"}, nil, "subject", "body", nil)
+	m.Parts = []Part{{Name: "big.bin", Data: want}}
+
+	raw, err := m.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	opts := ReadMessageOptions{
+		SpillDir:       dir,
+		SpillThreshold: 10,
+	}
+
+	got, err := ReadMessageWithOptions(bytes.NewReader(raw), opts)
+	if err != nil {
+		t.Fatalf("ReadMessageWithOptions: %v", err)
+	}
+	if len(got.Parts) != 1 || got.Parts[0].Reader == nil {
+		t.Fatalf("expected one spilled part, got %+v", got.Parts)
+	}
+
+	r := got.Parts[0].Open()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, want) {
+		t.Errorf("spilled part data mismatch")
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("tempfile not removed on Close: %v", entries)
+	}
+}